@@ -0,0 +1,376 @@
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// A Decoder decodes values from the D-Bus wire format. It is the
+// counterpart of Encoder: see Encoder's doc comment for the Go/D-Bus
+// type mapping, which applies symmetrically to decoding, including
+// StrictIntWidth and the Marshaler/Unmarshaler pair.
+type Decoder struct {
+	in    io.Reader
+	order binary.ByteOrder
+	pos   int
+
+	// StrictIntWidth makes decode panic when asked to decode into a Go
+	// int or uint, for the same reason Encoder.StrictIntWidth makes
+	// encode panic on them; see its doc comment.
+	StrictIntWidth bool
+
+	trace      io.Writer
+	traceDepth int
+
+	// depth is the container nesting depth that Decode resumes at; see
+	// Encoder.depth, which it mirrors.
+	depth int
+}
+
+// SetTrace makes dec write a human-readable trace of everything it
+// decodes to w, in the same format as Encoder.SetTrace, so a trace
+// recorded while encoding a message can be diffed against the trace of
+// decoding the same bytes back. Pass nil to disable tracing. The lines
+// for a container's length prefix and padding come in a different order
+// in the two traces: Encoder writes them after the container's contents,
+// which it builds in a scratch buffer first, while Decoder reads them
+// first.
+func (dec *Decoder) SetTrace(w io.Writer) {
+	dec.trace = w
+}
+
+// tracef writes a trace line if tracing is enabled; it is a no-op
+// otherwise.
+func (dec *Decoder) tracef(depth int, format string, args ...interface{}) {
+	if dec.trace == nil {
+		return
+	}
+	indent := ""
+	for i := 0; i < depth; i++ {
+		indent += "  "
+	}
+	fmt.Fprintf(dec.trace, "% 4d %s", dec.pos, indent)
+	fmt.Fprintf(dec.trace, format, args...)
+	fmt.Fprintln(dec.trace)
+}
+
+// NewDecoder returns a new decoder that reads from in in the given byte
+// order.
+func NewDecoder(in io.Reader, order binary.ByteOrder) *Decoder {
+	dec := new(Decoder)
+	dec.in = in
+	dec.order = order
+	return dec
+}
+
+// Reset reuses dec to read from in in the given byte order, as if it had
+// just been returned by NewDecoder: StrictIntWidth, SetTrace and any
+// in-progress container depth are all cleared along with the input and
+// position, mirroring Encoder.Reset, so a recycled Decoder can't leak
+// options or state from whatever it last decoded.
+func (dec *Decoder) Reset(in io.Reader, order binary.ByteOrder) {
+	dec.in = in
+	dec.order = order
+	dec.pos = 0
+	dec.StrictIntWidth = false
+	dec.trace = nil
+	dec.traceDepth = 0
+	dec.depth = 0
+}
+
+// Aligns the next read to be on a multiple of n. Panics on read errors.
+func (dec *Decoder) align(n int) {
+	if dec.pos%n != 0 {
+		newpos := (dec.pos + n - 1) & ^(n - 1)
+		empty := make([]byte, newpos-dec.pos)
+		if _, err := io.ReadFull(dec.in, empty); err != nil {
+			panic(err)
+		}
+		dec.tracef(dec.traceDepth, "PAD %d byte(s) for %d-byte alignment", len(empty), n)
+		dec.pos = newpos
+	}
+}
+
+// Calls binary.Read(dec.in, dec.order, v) and panics on read errors.
+func (dec *Decoder) binread(v interface{}) {
+	if err := binary.Read(dec.in, dec.order, v); err != nil {
+		panic(err)
+	}
+	if dec.trace != nil {
+		var raw bytes.Buffer
+		binary.Write(&raw, dec.order, v)
+		t := reflect.TypeOf(v).Elem()
+		dec.tracef(dec.traceDepth, "%s %s % x", t, getSignature(t), raw.Bytes())
+	}
+}
+
+// Decode decodes a single value of type t from the underlying reader.
+func (dec *Decoder) Decode(t reflect.Type) (v interface{}, err error) {
+	defer func() {
+		if e, ok := recover().(error); ok {
+			err = e
+		}
+	}()
+	rv := reflect.New(t).Elem()
+	dec.decode(rv, dec.depth)
+	return rv.Interface(), nil
+}
+
+// decode decodes into v and panics on error. depth holds the depth of
+// the container nesting.
+func (dec *Decoder) decode(v reflect.Value, depth int) {
+	if dec.decodeUnmarshaler(v, depth) {
+		return
+	}
+	dec.traceDepth = depth
+	dec.align(alignment(v.Type()))
+	switch v.Kind() {
+	case reflect.Uint8:
+		var b [1]byte
+		if _, err := io.ReadFull(dec.in, b[:]); err != nil {
+			panic(err)
+		}
+		dec.tracef(depth, "BYTE % x", b)
+		dec.pos++
+		v.SetUint(uint64(b[0]))
+	case reflect.Bool:
+		var u uint32
+		dec.decode(reflect.ValueOf(&u).Elem(), depth)
+		v.SetBool(u != 0)
+	case reflect.Int16:
+		var n int16
+		dec.binread(&n)
+		dec.pos += 2
+		v.SetInt(int64(n))
+	case reflect.Uint16:
+		var n uint16
+		dec.binread(&n)
+		dec.pos += 2
+		v.SetUint(uint64(n))
+	case reflect.Int32:
+		var n int32
+		dec.binread(&n)
+		dec.pos += 4
+		v.SetInt(int64(n))
+	case reflect.Uint32:
+		var n uint32
+		dec.binread(&n)
+		dec.pos += 4
+		v.SetUint(uint64(n))
+	case reflect.Int, reflect.Int64:
+		if v.Kind() == reflect.Int && dec.StrictIntWidth {
+			panic(invalidTypeError{v.Type()})
+		}
+		var n int64
+		dec.binread(&n)
+		dec.pos += 8
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint64:
+		if v.Kind() == reflect.Uint && dec.StrictIntWidth {
+			panic(invalidTypeError{v.Type()})
+		}
+		var n uint64
+		dec.binread(&n)
+		dec.pos += 8
+		v.SetUint(n)
+	case reflect.Float64:
+		var f float64
+		dec.binread(&f)
+		dec.pos += 8
+		v.SetFloat(f)
+	case reflect.String:
+		var length uint32
+		dec.decode(reflect.ValueOf(&length).Elem(), depth)
+		b := make([]byte, length+1)
+		if _, err := io.ReadFull(dec.in, b); err != nil {
+			panic(err)
+		}
+		s := string(b[:length])
+		dec.tracef(depth, "STRING %q", s)
+		dec.pos += len(b)
+		v.SetString(s)
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		dec.decode(v.Elem(), depth)
+	case reflect.Slice, reflect.Array:
+		if depth >= 64 {
+			panic(FormatError("input exceeds container depth limit"))
+		}
+		var length uint32
+		dec.decode(reflect.ValueOf(&length).Elem(), depth)
+		dec.tracef(depth, "BEGIN ARRAY %s", v.Type())
+		dec.align(alignment(v.Type().Elem()))
+		end := dec.pos + int(length)
+		var elems []reflect.Value
+		for dec.pos < end {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			dec.decode(elem, depth+1)
+			elems = append(elems, elem)
+		}
+		if v.Kind() == reflect.Slice {
+			s := reflect.MakeSlice(v.Type(), len(elems), len(elems))
+			for i, e := range elems {
+				s.Index(i).Set(e)
+			}
+			v.Set(s)
+		} else {
+			for i, e := range elems {
+				v.Index(i).Set(e)
+			}
+		}
+		dec.tracef(depth, "END ARRAY (%d bytes)", length)
+	case reflect.Struct:
+		if depth >= 64 && v.Type() != signatureType {
+			panic(FormatError("input exceeds container depth limit"))
+		}
+		switch t := v.Type(); t {
+		case signatureType:
+			var l byte
+			dec.decode(reflect.ValueOf(&l).Elem(), depth+1)
+			b := make([]byte, int(l)+1)
+			if _, err := io.ReadFull(dec.in, b); err != nil {
+				panic(err)
+			}
+			str := string(b[:l])
+			dec.tracef(depth, "SIGNATURE %q", str)
+			dec.pos += len(b)
+			v.Set(reflect.ValueOf(Signature{str}))
+		case variantType:
+			dec.tracef(depth, "BEGIN VARIANT")
+			var sig Signature
+			dec.decode(reflect.ValueOf(&sig).Elem(), depth+1)
+			rv := reflect.New(typeFor(sig)).Elem()
+			dec.decode(rv, depth+1)
+			v.Set(reflect.ValueOf(Variant{sig, rv.Interface()}))
+			dec.tracef(depth, "END VARIANT")
+		default:
+			dec.tracef(depth, "BEGIN STRUCT %s", t)
+			for i := 0; i < t.NumField(); i++ {
+				field := t.Field(i)
+				if field.PkgPath == "" && field.Tag.Get("dbus") != "-" {
+					dec.decode(v.Field(i), depth+1)
+				}
+			}
+			dec.tracef(depth, "END STRUCT %s", t)
+		}
+	case reflect.Map:
+		if depth >= 63 {
+			panic(FormatError("input exceeds container depth limit"))
+		}
+		if !isKeyType(v.Type().Key()) {
+			panic(invalidTypeError{v.Type()})
+		}
+		var length uint32
+		dec.decode(reflect.ValueOf(&length).Elem(), depth)
+		dec.tracef(depth, "BEGIN DICT %s", v.Type())
+		dec.align(8)
+		end := dec.pos + int(length)
+		m := reflect.MakeMap(v.Type())
+		for dec.pos < end {
+			dec.align(8)
+			k := reflect.New(v.Type().Key()).Elem()
+			dec.decode(k, depth+2)
+			val := reflect.New(v.Type().Elem()).Elem()
+			dec.decode(val, depth+2)
+			m.SetMapIndex(k, val)
+		}
+		v.Set(m)
+		dec.tracef(depth, "END DICT (%d bytes)", length)
+	default:
+		panic(invalidTypeError{v.Type()})
+	}
+}
+
+// decodeUnmarshaler decodes into v using the Unmarshaler interface if
+// v's address implements it, and reports whether it did so. Callers
+// fall back to the reflection-driven path when it returns false. dec is
+// aligned to the boundary v's signature requires before UnmarshalDBus
+// reads from it directly, mirroring Encoder.encodeMarshaler - including
+// its depth enforcement, which matters here even more than on the encode
+// side: UnmarshalDBus runs on bytes from a remote bus peer, so without it
+// a chain of nested Unmarshaler-wrapped values would let a hostile peer
+// bypass the container-depth cap entirely.
+func (dec *Decoder) decodeUnmarshaler(v reflect.Value, depth int) bool {
+	if !v.CanAddr() || !v.Addr().Type().Implements(unmarshalerType) {
+		return false
+	}
+	if depth >= 64 {
+		panic(FormatError("input exceeds container depth limit"))
+	}
+	u := v.Addr().Interface().(Unmarshaler)
+	dec.align(sigAlignment(u.Signature()))
+	saved := dec.depth
+	dec.depth = depth + 1
+	defer func() { dec.depth = saved }()
+	if err := u.UnmarshalDBus(dec); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// typeFor returns the Go type decode should use to hold a value of
+// signature sig when decoding into a Variant, whose element type isn't
+// known statically. It covers the basic D-Bus types plus generic
+// slice/map/struct containers of them; it does not resolve back to a
+// Marshaler-backed type, since a Variant read off the wire has no record
+// of which Go type originally produced its signature.
+func typeFor(sig Signature) reflect.Type {
+	t, rest := typeForPrefix(sig.str)
+	if rest != "" {
+		panic(FormatError("invalid signature " + sig.str))
+	}
+	return t
+}
+
+func typeForPrefix(s string) (reflect.Type, string) {
+	if s == "" {
+		panic(FormatError("empty signature"))
+	}
+	switch s[0] {
+	case 'y':
+		return reflect.TypeOf(byte(0)), s[1:]
+	case 'b':
+		return reflect.TypeOf(false), s[1:]
+	case 'n':
+		return reflect.TypeOf(int16(0)), s[1:]
+	case 'q':
+		return reflect.TypeOf(uint16(0)), s[1:]
+	case 'i':
+		return reflect.TypeOf(int32(0)), s[1:]
+	case 'u':
+		return reflect.TypeOf(uint32(0)), s[1:]
+	case 'x':
+		return reflect.TypeOf(int64(0)), s[1:]
+	case 't':
+		return reflect.TypeOf(uint64(0)), s[1:]
+	case 'd':
+		return reflect.TypeOf(float64(0)), s[1:]
+	case 's':
+		return reflect.TypeOf(""), s[1:]
+	case 'o':
+		return objectPathType, s[1:]
+	case 'g':
+		return signatureType, s[1:]
+	case 'h':
+		return unixFDIndexType, s[1:]
+	case 'v':
+		return variantType, s[1:]
+	case 'a':
+		rest := s[1:]
+		if strings.HasPrefix(rest, "{") {
+			keyType, rest2 := typeForPrefix(rest[1:])
+			valType, rest3 := typeForPrefix(rest2)
+			if !strings.HasPrefix(rest3, "}") {
+				panic(FormatError("invalid dict signature " + s))
+			}
+			return reflect.MapOf(keyType, valType), rest3[1:]
+		}
+		elem, rest2 := typeForPrefix(rest)
+		return reflect.SliceOf(elem), rest2
+	}
+	panic(FormatError("unsupported signature " + s))
+}
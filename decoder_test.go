@@ -0,0 +1,28 @@
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecoderResetClearsOptions(t *testing.T) {
+	var buf bytes.Buffer
+	dec := NewDecoder(&buf, binary.LittleEndian)
+	dec.StrictIntWidth = true
+	dec.SetTrace(&bytes.Buffer{})
+	dec.traceDepth = 2
+	dec.depth = 3
+
+	dec.Reset(&buf, binary.LittleEndian)
+
+	if dec.StrictIntWidth {
+		t.Error("Reset left StrictIntWidth set")
+	}
+	if dec.trace != nil {
+		t.Error("Reset left tracing enabled")
+	}
+	if dec.traceDepth != 0 || dec.depth != 0 {
+		t.Errorf("Reset left traceDepth=%d depth=%d, want both 0", dec.traceDepth, dec.depth)
+	}
+}
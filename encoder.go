@@ -3,8 +3,10 @@ package dbus
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"reflect"
+	"sync"
 )
 
 // An Encoder encodes values to the D-Bus wire format.
@@ -20,8 +22,8 @@ import (
 //     uint16      | UINT16
 //     int32       | INT32
 //     uint32      | UINT32
-//     int64       | INT64
-//     uint64      | UINT64
+//     int, int64  | INT64
+//     uint, uint64| UINT64
 //     float64     | DOUBLE
 //     string      | STRING
 //     ObjectPath  | OBJECT_PATH
@@ -39,12 +41,74 @@ import (
 //
 // Pointers encode as the value they're pointed to.
 //
-// Trying to encode any other type (including int and uint) or a slice, map or
-// struct containing an unsupported type will result in a panic.
+// Named types dispatch on their underlying Kind, so e.g. a `type State
+// uint32` encodes as UINT32 without any manual conversion. int and uint
+// encode as INT64/UINT64 unless Encoder.StrictIntWidth is set, matching
+// how encoding/gob normalises platform-width integers; alignment and
+// SignatureOf compute the same width for these types so a value
+// round-trips through a Variant with a stable signature.
+//
+// Trying to encode any other type or a slice, map or struct containing an
+// unsupported type will result in a panic.
 type Encoder struct {
 	out   io.Writer
 	order binary.ByteOrder
 	pos   int
+
+	// StrictIntWidth makes encode panic on Go int and uint values instead
+	// of normalising them to INT64/UINT64. It defaults to false, so named
+	// types such as `type State uint32` and the platform-width int/uint
+	// round-trip through a Variant without manual conversion; set it to
+	// restore the old behaviour for callers who want to catch accidental
+	// width ambiguity.
+	StrictIntWidth bool
+
+	trace io.Writer
+	// base is added to pos when tracing, so a scratch encoder used to
+	// build a container's elements (see getScratch) reports the wire
+	// positions the elements land at once the container's length prefix
+	// and padding are written, instead of positions relative to its own
+	// scratch buffer.
+	base int
+	// traceDepth is the container nesting depth of the value encode is
+	// currently handling; align and binwrite read it so their trace lines
+	// indent like the rest of a container's trace.
+	traceDepth int
+
+	// depth is the container nesting depth that Encode/EncodeMulti resume
+	// at. It is 0 except while encodeMarshaler is running a Marshaler's
+	// MarshalDBus, during which it holds the depth one level past the
+	// Marshaler value itself, so any enc.Encode call MarshalDBus makes -
+	// including one on a value that is itself a Marshaler - stays subject
+	// to the same container-depth cap as a plain struct field would be.
+	depth int
+}
+
+// SetTrace makes enc write a human-readable trace of everything it
+// encodes to w: the wire position before each value, the alignment
+// padding inserted, the Go type, the D-Bus type code, the raw bytes in
+// hex and the current container nesting depth, with BEGIN/END markers
+// around arrays, dicts, structs and variants. Pass nil to disable
+// tracing. It is meant for debugging interop problems with other D-Bus
+// implementations, where a malformed message otherwise just panics with
+// no clue which field corrupted the stream.
+func (enc *Encoder) SetTrace(w io.Writer) {
+	enc.trace = w
+}
+
+// tracef writes a trace line if tracing is enabled; it is a no-op
+// otherwise.
+func (enc *Encoder) tracef(depth int, format string, args ...interface{}) {
+	if enc.trace == nil {
+		return
+	}
+	indent := ""
+	for i := 0; i < depth; i++ {
+		indent += "  "
+	}
+	fmt.Fprintf(enc.trace, "% 4d %s", enc.base+enc.pos, indent)
+	fmt.Fprintf(enc.trace, format, args...)
+	fmt.Fprintln(enc.trace)
 }
 
 // NewEncoder returns a new encoder that writes to out in the given byte order.
@@ -55,6 +119,72 @@ func NewEncoder(out io.Writer, order binary.ByteOrder) *Encoder {
 	return enc
 }
 
+// Reset reuses enc to write to out in the given byte order, as if it had
+// just been returned by NewEncoder: StrictIntWidth, SetTrace and any
+// in-progress container depth are all cleared along with the output and
+// position, so a recycled Encoder can't leak options or state from
+// whatever it last encoded. Callers that encode many messages, such as
+// Conn.Send, can use it to recycle an Encoder instead of allocating a new
+// one per message. getScratch calls Reset on a scratchEncoder and then
+// copies the owning Encoder's options back onto it, since the container
+// it's building must inherit them.
+func (enc *Encoder) Reset(out io.Writer, order binary.ByteOrder) {
+	enc.out = out
+	enc.order = order
+	enc.pos = 0
+	enc.StrictIntWidth = false
+	enc.trace = nil
+	enc.base = 0
+	enc.traceDepth = 0
+	enc.depth = 0
+}
+
+// scratchPool holds the *bytes.Buffer/*Encoder pairs used to encode the
+// elements of a slice, array or map before their length prefix is known.
+// Pooling them avoids allocating a fresh buffer and encoder for every
+// container, which otherwise dominates CPU and GC time for messages
+// carrying large a{sv} property dictionaries; see BenchmarkEncodeProperties.
+//
+// This still builds each container into a side buffer and copies it,
+// rather than writing straight into enc.out and back-patching the length
+// prefix in place. The latter needs a Writer that supports seeking back
+// over already-written bytes (or buffering the whole message up front),
+// which no caller of Encoder currently provides; pooling the side buffer
+// removes the allocation cost without requiring that wider change.
+var scratchPool = sync.Pool{
+	New: func() interface{} {
+		buf := new(bytes.Buffer)
+		return &scratchEncoder{buf: buf, enc: NewEncoder(buf, binary.LittleEndian)}
+	},
+}
+
+type scratchEncoder struct {
+	buf *bytes.Buffer
+	enc *Encoder
+}
+
+// getScratch returns a pooled encoder writing into a pooled buffer, reset
+// to encode in enc's byte order and inheriting enc's options so nested
+// elements behave exactly as they would on enc itself. elemAlign is the
+// alignment the container's contents are padded to after its length
+// prefix, so traced positions match where the contents land on the wire.
+// Callers must return it with putScratch.
+func (enc *Encoder) getScratch(elemAlign int) *scratchEncoder {
+	s := scratchPool.Get().(*scratchEncoder)
+	s.buf.Reset()
+	s.enc.Reset(s.buf, enc.order)
+	s.enc.StrictIntWidth = enc.StrictIntWidth
+	s.enc.trace = enc.trace
+	start := (enc.pos+3)&^3 + 4
+	start = (start + elemAlign - 1) & ^(elemAlign - 1)
+	s.enc.base = enc.base + start
+	return s
+}
+
+func putScratch(s *scratchEncoder) {
+	scratchPool.Put(s)
+}
+
 // Aligns the next output to be on a multiple of n. Panics on write errors.
 func (enc *Encoder) align(n int) {
 	if enc.pos%n != 0 {
@@ -63,6 +193,7 @@ func (enc *Encoder) align(n int) {
 		if _, err := enc.out.Write(empty); err != nil {
 			panic(err)
 		}
+		enc.tracef(enc.traceDepth, "PAD %d byte(s) for %d-byte alignment", len(empty), n)
 		enc.pos = newpos
 	}
 }
@@ -72,22 +203,40 @@ func (enc *Encoder) binwrite(v interface{}) {
 	if err := binary.Write(enc.out, enc.order, v); err != nil {
 		panic(err)
 	}
+	if enc.trace != nil {
+		var raw bytes.Buffer
+		binary.Write(&raw, enc.order, v)
+		enc.tracef(enc.traceDepth, "%T %s % x", v, getSignature(reflect.TypeOf(v)), raw.Bytes())
+	}
+}
+
+// nulByte is the shared scratch writeNul writes from.
+var nulByte [1]byte
+
+// writeNul writes the single NUL byte D-Bus requires after every STRING,
+// OBJECT_PATH and SIGNATURE, using a shared scratch array instead of
+// allocating a one-off slice for it.
+func (enc *Encoder) writeNul() {
+	if _, err := enc.out.Write(nulByte[:]); err != nil {
+		panic(err)
+	}
+	enc.pos++
 }
 
 // Encode encodes a single value to the underyling reader. All written values
 // are aligned properly as required by the DBus spec.
 func (enc *Encoder) Encode(v interface{}) (err error) {
 	defer func() {
-		err, ok := recover().(error)
-		if ok {
+		if e, ok := recover().(error); ok {
 			// invalidTypeErrors are errors in the program and can't really be
 			// recovered from
-			if _, ok := err.(invalidTypeError); ok {
-				panic(err)
+			if _, ok := e.(invalidTypeError); ok {
+				panic(e)
 			}
+			err = e
 		}
 	}()
-	enc.encode(reflect.ValueOf(v), 0)
+	enc.encode(reflect.ValueOf(v), enc.depth)
 	return nil
 }
 
@@ -104,6 +253,10 @@ func (enc *Encoder) EncodeMulti(vs ...interface{}) error {
 // encode encodes the given value to the writer and panics on error. depth holds
 // the depth of the container nesting.
 func (enc *Encoder) encode(v reflect.Value, depth int) {
+	if enc.encodeMarshaler(v, depth) {
+		return
+	}
+	enc.traceDepth = depth
 	enc.align(alignment(v.Type()))
 	switch v.Kind() {
 	case reflect.Uint8:
@@ -112,6 +265,7 @@ func (enc *Encoder) encode(v reflect.Value, depth int) {
 		if _, err := enc.out.Write(b[:]); err != nil {
 			panic(err)
 		}
+		enc.tracef(depth, "BYTE % x", b)
 		enc.pos++
 	case reflect.Bool:
 		if v.Bool() {
@@ -131,44 +285,51 @@ func (enc *Encoder) encode(v reflect.Value, depth int) {
 	case reflect.Uint32:
 		enc.binwrite(uint32(v.Uint()))
 		enc.pos += 4
-	case reflect.Int64:
+	case reflect.Int, reflect.Int64:
+		if v.Kind() == reflect.Int && enc.StrictIntWidth {
+			panic(invalidTypeError{v.Type()})
+		}
 		enc.binwrite(v.Int())
 		enc.pos += 8
-	case reflect.Uint64:
+	case reflect.Uint, reflect.Uint64:
+		if v.Kind() == reflect.Uint && enc.StrictIntWidth {
+			panic(invalidTypeError{v.Type()})
+		}
 		enc.binwrite(v.Uint())
 		enc.pos += 8
 	case reflect.Float64:
 		enc.binwrite(v.Float())
 		enc.pos += 8
 	case reflect.String:
-		enc.encode(reflect.ValueOf(uint32(len(v.String()))), depth)
-		b := make([]byte, v.Len()+1)
-		copy(b, v.String())
-		b[len(b)-1] = 0
-		n, err := enc.out.Write(b)
+		s := v.String()
+		enc.encode(reflect.ValueOf(uint32(len(s))), depth)
+		n, err := io.WriteString(enc.out, s)
 		if err != nil {
 			panic(err)
 		}
+		enc.tracef(depth, "STRING %q", s)
 		enc.pos += n
+		enc.writeNul()
 	case reflect.Ptr:
 		enc.encode(v.Elem(), depth)
 	case reflect.Slice, reflect.Array:
 		if depth >= 64 {
 			panic(FormatError("input exceeds container depth limit"))
 		}
-		var buf bytes.Buffer
-		bufenc := NewEncoder(&buf, enc.order)
-
+		enc.tracef(depth, "BEGIN ARRAY %s", v.Type())
+		s := enc.getScratch(alignment(v.Type().Elem()))
+		defer putScratch(s)
 		for i := 0; i < v.Len(); i++ {
-			bufenc.encode(v.Index(i), depth+1)
+			s.enc.encode(v.Index(i), depth+1)
 		}
-		enc.encode(reflect.ValueOf(uint32(buf.Len())), depth)
-		length := buf.Len()
+		enc.encode(reflect.ValueOf(uint32(s.buf.Len())), depth)
+		length := s.buf.Len()
 		enc.align(alignment(v.Type().Elem()))
-		if _, err := buf.WriteTo(enc.out); err != nil {
+		if _, err := s.buf.WriteTo(enc.out); err != nil {
 			panic(err)
 		}
 		enc.pos += length
+		enc.tracef(depth, "END ARRAY (%d bytes)", length)
 	case reflect.Struct:
 		if depth >= 64 && v.Type() != signatureType {
 			panic(FormatError("input exceeds container depth limit"))
@@ -177,25 +338,28 @@ func (enc *Encoder) encode(v reflect.Value, depth int) {
 		case signatureType:
 			str := v.Field(0)
 			enc.encode(reflect.ValueOf(byte(str.Len())), depth+1)
-			b := make([]byte, str.Len()+1)
-			copy(b, str.String())
-			b[len(b)-1] = 0
-			n, err := enc.out.Write(b)
+			n, err := io.WriteString(enc.out, str.String())
 			if err != nil {
 				panic(err)
 			}
+			enc.tracef(depth, "SIGNATURE %q", str.String())
 			enc.pos += n
+			enc.writeNul()
 		case variantType:
 			variant := v.Interface().(Variant)
+			enc.tracef(depth, "BEGIN VARIANT")
 			enc.encode(reflect.ValueOf(variant.sig), depth+1)
 			enc.encode(reflect.ValueOf(variant.value), depth+1)
+			enc.tracef(depth, "END VARIANT")
 		default:
+			enc.tracef(depth, "BEGIN STRUCT %s", t)
 			for i := 0; i < v.Type().NumField(); i++ {
 				field := t.Field(i)
 				if field.PkgPath == "" && field.Tag.Get("dbus") != "-" {
 					enc.encode(v.Field(i), depth+1)
 				}
 			}
+			enc.tracef(depth, "END STRUCT %s", t)
 		}
 	case reflect.Map:
 		// Maps are arrays of structures, so they actually increase the depth by
@@ -207,21 +371,79 @@ func (enc *Encoder) encode(v reflect.Value, depth int) {
 			panic(invalidTypeError{v.Type()})
 		}
 		keys := v.MapKeys()
-		var buf bytes.Buffer
-		bufenc := NewEncoder(&buf, enc.order)
+		enc.tracef(depth, "BEGIN DICT %s", v.Type())
+		s := enc.getScratch(8)
+		defer putScratch(s)
 		for _, k := range keys {
-			bufenc.align(8)
-			bufenc.encode(k, depth+2)
-			bufenc.encode(v.MapIndex(k), depth+2)
+			s.enc.align(8)
+			s.enc.encode(k, depth+2)
+			s.enc.encode(v.MapIndex(k), depth+2)
 		}
-		enc.encode(reflect.ValueOf(uint32(buf.Len())), depth)
-		length := buf.Len()
+		enc.encode(reflect.ValueOf(uint32(s.buf.Len())), depth)
+		length := s.buf.Len()
 		enc.align(8)
-		if _, err := buf.WriteTo(enc.out); err != nil {
+		if _, err := s.buf.WriteTo(enc.out); err != nil {
 			panic(err)
 		}
 		enc.pos += length
+		enc.tracef(depth, "END DICT (%d bytes)", length)
 	default:
 		panic(invalidTypeError{v.Type()})
 	}
 }
+
+// encodeMarshaler encodes v using the Marshaler interface if v, or its
+// address when addressable, implements it, and reports whether it did so.
+// Callers fall back to the reflection-driven path when it returns false.
+// enc is aligned to the boundary m's signature requires, then handed to
+// MarshalDBus directly, so depth and alignment bookkeeping stay
+// consistent with the rest of encode and the written bytes can be read
+// back by the matching Unmarshaler via Decoder.decodeUnmarshaler.
+//
+// depth is enforced here, not just left to the switch in encode: a
+// Marshaler's MarshalDBus body never reaches that switch directly, so
+// without this check a chain of Marshaler-wrapped values nested inside
+// one another (e.g. each one's MarshalDBus calling enc.Encode on the
+// next) would bypass the container-depth cap entirely.
+func (enc *Encoder) encodeMarshaler(v reflect.Value, depth int) bool {
+	var m Marshaler
+	switch {
+	case v.Type().Implements(marshalerType):
+		m = v.Interface().(Marshaler)
+	case v.CanAddr() && v.Addr().Type().Implements(marshalerType):
+		m = v.Addr().Interface().(Marshaler)
+	default:
+		return false
+	}
+	if depth >= 64 {
+		panic(FormatError("input exceeds container depth limit"))
+	}
+	enc.align(sigAlignment(m.Signature()))
+	saved := enc.depth
+	enc.depth = depth + 1
+	defer func() { enc.depth = saved }()
+	if err := m.MarshalDBus(enc); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// sigAlignment returns the alignment required by the first complete type
+// of sig, as mandated by the D-Bus marshalling spec.
+func sigAlignment(sig Signature) int {
+	if sig.str == "" {
+		return 1
+	}
+	switch sig.str[0] {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'b', 'i', 'u', 'h', 's', 'o', 'a':
+		return 4
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,29 @@
+package dbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestEncoderResetClearsOptions(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, binary.LittleEndian)
+	enc.StrictIntWidth = true
+	enc.SetTrace(&bytes.Buffer{})
+	enc.base = 4
+	enc.traceDepth = 2
+	enc.depth = 3
+
+	enc.Reset(&buf, binary.LittleEndian)
+
+	if enc.StrictIntWidth {
+		t.Error("Reset left StrictIntWidth set")
+	}
+	if enc.trace != nil {
+		t.Error("Reset left tracing enabled")
+	}
+	if enc.base != 0 || enc.traceDepth != 0 || enc.depth != 0 {
+		t.Errorf("Reset left base=%d traceDepth=%d depth=%d, want all 0", enc.base, enc.traceDepth, enc.depth)
+	}
+}
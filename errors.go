@@ -0,0 +1,21 @@
+package dbus
+
+import "reflect"
+
+// FormatError signals that encoded or decoded data does not conform to
+// the D-Bus wire format, as opposed to the Go value being unsupported.
+type FormatError string
+
+func (e FormatError) Error() string {
+	return "dbus: wire format error: " + string(e)
+}
+
+// invalidTypeError signals that a Go value cannot be represented in the
+// D-Bus wire format at all.
+type invalidTypeError struct {
+	reflect.Type
+}
+
+func (e invalidTypeError) Error() string {
+	return "dbus: invalid type " + e.Type.String()
+}
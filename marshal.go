@@ -0,0 +1,41 @@
+package dbus
+
+import "reflect"
+
+// Marshaler is the interface implemented by types that can marshal
+// themselves into the D-Bus wire format. It lets types whose Go
+// representation has no direct D-Bus equivalent (time.Time, net.IP, enum
+// wrappers, big.Int, ...) expose themselves as a supported
+// wire type instead of making Encoder.encode panic.
+//
+// MarshalDBus must write exactly the values described by Signature to
+// enc, using enc.Encode/enc.EncodeMulti (or equivalent primitives) so
+// that alignment and container-depth bookkeeping stay consistent with
+// the rest of the message; enc carries the current nesting depth across
+// the call, so a Marshaler that itself contains (or is) a nested
+// Marshaler stays subject to the same depth cap as a plain struct field.
+// Signature is consulted both to align the written bytes and, via
+// SignatureOf/getSignature, to compute the signature of any Variant or
+// method call argument containing the receiver, so it must not depend on
+// the receiver's value.
+type Marshaler interface {
+	MarshalDBus(enc *Encoder) error
+	Signature() Signature
+}
+
+// Unmarshaler is the interface implemented by types that can unmarshal a
+// D-Bus wire representation of themselves. It is the streaming
+// counterpart of Marshaler: UnmarshalDBus must read exactly the values
+// Signature describes from dec, the same way MarshalDBus wrote them, so
+// Decoder.decode's alignment and container-depth bookkeeping stays
+// consistent across the round trip, including the depth cap that guards
+// against malicious or malformed input from a remote bus peer.
+type Unmarshaler interface {
+	Signature() Signature
+	UnmarshalDBus(dec *Decoder) error
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
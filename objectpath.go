@@ -0,0 +1,15 @@
+package dbus
+
+import "regexp"
+
+// ObjectPath represents a D-Bus object path, as defined by the D-Bus
+// specification. It encodes like a string but has its own D-Bus type
+// code ('o' rather than 's').
+type ObjectPath string
+
+var objectPathRegexp = regexp.MustCompile(`^/([a-zA-Z0-9_]+(/[a-zA-Z0-9_]+)*)?$`)
+
+// IsValid reports whether o is a syntactically valid object path.
+func (o ObjectPath) IsValid() bool {
+	return objectPathRegexp.MatchString(string(o))
+}
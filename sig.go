@@ -0,0 +1,163 @@
+package dbus
+
+import "reflect"
+
+// Signature represents a D-Bus signature, a string of type codes
+// describing a sequence of complete types.
+type Signature struct {
+	str string
+}
+
+// String returns the signature's string representation.
+func (s Signature) String() string {
+	return s.str
+}
+
+// Empty reports whether s is the empty signature.
+func (s Signature) Empty() bool {
+	return s.str == ""
+}
+
+var (
+	signatureType   = reflect.TypeOf(Signature{})
+	variantType     = reflect.TypeOf(Variant{})
+	objectPathType  = reflect.TypeOf(ObjectPath(""))
+	unixFDIndexType = reflect.TypeOf(UnixFDIndex(0))
+)
+
+// isKeyType reports whether t is a valid D-Bus dict key type: a basic
+// type, never a container.
+func isKeyType(t reflect.Type) bool {
+	if t == signatureType || t == objectPathType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Uint8, reflect.Bool, reflect.Int16, reflect.Uint16,
+		reflect.Int32, reflect.Uint32, reflect.Int, reflect.Int64,
+		reflect.Uint, reflect.Uint64, reflect.Float64, reflect.String:
+		return true
+	}
+	return false
+}
+
+// alignment returns the byte boundary a value of type t must be aligned
+// to when encoded or decoded, as mandated by the D-Bus marshalling spec.
+// Like getSignature, it normalises Go's platform-width int/uint to the
+// same 8-byte alignment as their fixed-width INT64/UINT64 counterparts,
+// so the two stay consistent with each other. A type implementing
+// Marshaler is aligned by the first type of its Signature.
+func alignment(t reflect.Type) int {
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		return sigAlignment(marshalerSignature(t))
+	}
+	switch t.Kind() {
+	case reflect.Uint8:
+		return 1
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Bool, reflect.Int32, reflect.Uint32:
+		return 4
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64, reflect.Float64:
+		return 8
+	case reflect.String:
+		return 4
+	case reflect.Ptr:
+		return alignment(t.Elem())
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return 4
+	case reflect.Struct:
+		if t == signatureType {
+			return 1
+		}
+		if t == variantType {
+			return 1
+		}
+		return 8
+	}
+	return 1
+}
+
+// getSignature returns the D-Bus signature string for t, consulting
+// Marshaler for any type that implements it.
+func getSignature(t reflect.Type) string {
+	switch t {
+	case signatureType:
+		return "g"
+	case variantType:
+		return "v"
+	case objectPathType:
+		return "o"
+	case unixFDIndexType:
+		return "h"
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		return marshalerSignature(t).str
+	}
+	switch t.Kind() {
+	case reflect.Uint8:
+		return "y"
+	case reflect.Bool:
+		return "b"
+	case reflect.Int16:
+		return "n"
+	case reflect.Uint16:
+		return "q"
+	case reflect.Int32:
+		return "i"
+	case reflect.Uint32:
+		return "u"
+	case reflect.Int, reflect.Int64:
+		return "x"
+	case reflect.Uint, reflect.Uint64:
+		return "t"
+	case reflect.Float64:
+		return "d"
+	case reflect.String:
+		return "s"
+	case reflect.Ptr:
+		return getSignature(t.Elem())
+	case reflect.Slice, reflect.Array:
+		return "a" + getSignature(t.Elem())
+	case reflect.Map:
+		if !isKeyType(t.Key()) {
+			panic(invalidTypeError{t})
+		}
+		return "a{" + getSignature(t.Key()) + getSignature(t.Elem()) + "}"
+	case reflect.Struct:
+		sig := "("
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath == "" && field.Tag.Get("dbus") != "-" {
+				sig += getSignature(field.Type)
+			}
+		}
+		return sig + ")"
+	}
+	panic(invalidTypeError{t})
+}
+
+// marshalerSignature obtains the signature of a type implementing
+// Marshaler by calling its Signature method on a zero value.
+func marshalerSignature(t reflect.Type) Signature {
+	elem := t
+	if elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+	zero := reflect.New(elem)
+	if m, ok := zero.Interface().(Marshaler); ok {
+		return m.Signature()
+	}
+	if m, ok := zero.Elem().Interface().(Marshaler); ok {
+		return m.Signature()
+	}
+	panic(invalidTypeError{t})
+}
+
+// SignatureOf returns the concatenated signature of the given values.
+func SignatureOf(vs ...interface{}) Signature {
+	var s string
+	for _, v := range vs {
+		s += getSignature(reflect.TypeOf(v))
+	}
+	return Signature{s}
+}
@@ -0,0 +1,34 @@
+package dbus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAlignmentOfPlatformWidthInt(t *testing.T) {
+	want := 8
+	for _, v := range []interface{}{int(0), uint(0), int64(0), uint64(0)} {
+		got := alignment(reflect.TypeOf(v))
+		if got != want {
+			t.Errorf("alignment(%T) = %d, want %d", v, got, want)
+		}
+	}
+}
+
+func TestSignatureOfPlatformWidthInt(t *testing.T) {
+	cases := []struct {
+		v    interface{}
+		want string
+	}{
+		{int(0), "x"},
+		{uint(0), "t"},
+		{int64(0), "x"},
+		{uint64(0), "t"},
+	}
+	for _, c := range cases {
+		got := SignatureOf(c.v).String()
+		if got != c.want {
+			t.Errorf("SignatureOf(%T).String() = %q, want %q", c.v, got, c.want)
+		}
+	}
+}
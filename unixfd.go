@@ -0,0 +1,8 @@
+package dbus
+
+// UnixFDIndex represents the wire-format index of a file descriptor
+// passed out-of-band alongside a message. It encodes like a uint32 but
+// has its own D-Bus type code ('h' rather than 'u'); the descriptor
+// itself travels via the transport's ancillary data, not the message
+// body.
+type UnixFDIndex uint32
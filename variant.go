@@ -0,0 +1,31 @@
+package dbus
+
+import "fmt"
+
+// Variant represents a D-Bus variant, a value tagged with its own
+// signature so it can be carried somewhere a static type would
+// otherwise be required.
+type Variant struct {
+	sig   Signature
+	value interface{}
+}
+
+// NewVariant returns a Variant holding v, computing its signature with
+// SignatureOf. It panics if v cannot be represented in D-Bus.
+func NewVariant(v interface{}) Variant {
+	return Variant{sig: SignatureOf(v), value: v}
+}
+
+// Signature returns the signature of the value held by v.
+func (v Variant) Signature() Signature {
+	return v.sig
+}
+
+// Value returns the value held by v.
+func (v Variant) Value() interface{} {
+	return v.value
+}
+
+func (v Variant) String() string {
+	return fmt.Sprintf("@%s %v", v.sig.str, v.value)
+}